@@ -0,0 +1,55 @@
+package rafthttp
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"io"
+)
+
+// Codec encodes and decodes the values that cross the wire between peers:
+// AppendEntries/RequestVote requests and responses, and raw commands.
+// ContentType identifies the codec in the HTTP Content-Type/Accept headers
+// so that a server speaking several codecs can pick the one the caller
+// asked for.
+type Codec interface {
+	Encode(io.Writer, interface{}) error
+	Decode(io.Reader, interface{}) error
+	ContentType() string
+}
+
+// JSONCodec is the original wire format: plain encoding/json. It accepts
+// any value, which makes it the natural default and fallback.
+type JSONCodec struct{}
+
+func (JSONCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func (JSONCodec) Decode(r io.Reader, v interface{}) error {
+	return json.NewDecoder(r).Decode(v)
+}
+
+func (JSONCodec) ContentType() string { return "application/json" }
+
+// GobCodec encodes traffic with encoding/gob instead of JSON, which is
+// cheaper to marshal for the large log-entry batches AppendEntries carries
+// on busy clusters. It is not Protocol Buffers: the wire format is
+// Go-specific (no other language can decode it) and isn't pinned to a
+// schema, so it gives none of the cross-language stability or tooling a
+// real protobuf codec would. Each call creates a fresh gob.Encoder/Decoder,
+// so every frame resends its value's type descriptor rather than only the
+// first one on a connection; that's a real cost on the persistent
+// AppendEntries stream (stream.go) that a stateful encoder could avoid,
+// just not one this type takes on. It works for any value JSONCodec does,
+// cmd []byte included.
+type GobCodec struct{}
+
+func (GobCodec) Encode(w io.Writer, v interface{}) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func (GobCodec) Decode(r io.Reader, v interface{}) error {
+	return gob.NewDecoder(r).Decode(v)
+}
+
+func (GobCodec) ContentType() string { return "application/x-gob" }
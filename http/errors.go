@@ -0,0 +1,83 @@
+package rafthttp
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error codes carried in errorResponse.Code. These are part of the wire
+// protocol, so don't renumber existing ones.
+const (
+	codeBadRequest = 1
+	codeNotLeader  = 2
+	codeTimeout    = 3
+	codeInternal   = 4
+)
+
+// errorResponse is the structured body returned for non-200 responses, in
+// place of the empty bodies the handlers used to send. It's encoded with
+// whatever Codec the request negotiated, same as a successful response.
+type errorResponse struct {
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	LeaderHint string `json:"leader_hint,omitempty"`
+}
+
+// ErrBadRequest means the server rejected the request as malformed: an
+// undecodable body, an unparsable peer URL in SetConfiguration, or missing
+// or invalid snapshot headers in InstallSnapshot.
+type ErrBadRequest struct{ Message string }
+
+func (e *ErrBadRequest) Error() string { return e.Message }
+
+// ErrNotLeader means the peer isn't the Raft leader. If the peer knows who
+// is, LeaderURL is the leader's base URL and safe to retry Command against.
+type ErrNotLeader struct {
+	Message   string
+	LeaderURL string
+}
+
+func (e *ErrNotLeader) Error() string { return e.Message }
+
+// ErrTimeout means the server gave up waiting for the command to complete.
+type ErrTimeout struct{ Message string }
+
+func (e *ErrTimeout) Error() string { return e.Message }
+
+// writeError encodes a structured error envelope with the given HTTP
+// status, in place of http.Error's plain-text body.
+func writeError(w http.ResponseWriter, codec Codec, status, code int, message, leaderHint string) {
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.WriteHeader(status)
+	codec.Encode(w, errorResponse{Code: code, Message: message, LeaderHint: leaderHint})
+}
+
+// parseError turns a non-200 HTTP response into one of the typed Err*
+// values above, decoding the envelope with codec. If the body isn't a
+// valid envelope (e.g. the peer predates structured errors), it falls back
+// to a plain error carrying the HTTP status.
+func parseError(resp *http.Response, codec Codec) error {
+	var body errorResponse
+	if err := codec.Decode(resp.Body, &body); err != nil {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	switch body.Code {
+	case codeNotLeader:
+		return &ErrNotLeader{Message: body.Message, LeaderURL: body.LeaderHint}
+	case codeTimeout:
+		return &ErrTimeout{Message: body.Message}
+	case codeBadRequest:
+		return &ErrBadRequest{Message: body.Message}
+	default:
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, body.Message)
+	}
+}
+
+// isNotLeader reports whether err is the raft package's way of saying "I'm
+// not the leader", without depending on a specific sentinel error value
+// from that package.
+func isNotLeader(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "not leader")
+}
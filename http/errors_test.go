@@ -0,0 +1,130 @@
+package rafthttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func doWriteError(status, code int, message, leaderHint string) *http.Response {
+	rec := httptest.NewRecorder()
+	writeError(rec, JSONCodec{}, status, code, message, leaderHint)
+	return rec.Result()
+}
+
+func TestParseErrorNotLeader(t *testing.T) {
+	resp := doWriteError(http.StatusPreconditionFailed, codeNotLeader, "not leader", "http://leader:8080")
+	defer resp.Body.Close()
+
+	err := parseError(resp, JSONCodec{})
+	notLeader, ok := err.(*ErrNotLeader)
+	if !ok {
+		t.Fatalf("parseError returned %T, want *ErrNotLeader", err)
+	}
+	if notLeader.LeaderURL != "http://leader:8080" {
+		t.Errorf("LeaderURL = %q, want %q", notLeader.LeaderURL, "http://leader:8080")
+	}
+	if notLeader.Message != "not leader" {
+		t.Errorf("Message = %q, want %q", notLeader.Message, "not leader")
+	}
+}
+
+func TestParseErrorTimeout(t *testing.T) {
+	resp := doWriteError(http.StatusServiceUnavailable, codeTimeout, "timed out waiting for command", "")
+	defer resp.Body.Close()
+
+	err := parseError(resp, JSONCodec{})
+	if _, ok := err.(*ErrTimeout); !ok {
+		t.Fatalf("parseError returned %T, want *ErrTimeout", err)
+	}
+}
+
+func TestParseErrorBadRequest(t *testing.T) {
+	resp := doWriteError(http.StatusBadRequest, codeBadRequest, "bad request", "")
+	defer resp.Body.Close()
+
+	err := parseError(resp, JSONCodec{})
+	if _, ok := err.(*ErrBadRequest); !ok {
+		t.Fatalf("parseError returned %T, want *ErrBadRequest", err)
+	}
+}
+
+func TestParseErrorUnknownCode(t *testing.T) {
+	resp := doWriteError(http.StatusInternalServerError, 0, "something broke", "")
+	defer resp.Body.Close()
+
+	err := parseError(resp, JSONCodec{})
+	switch err.(type) {
+	case *ErrNotLeader, *ErrTimeout, *ErrBadRequest:
+		t.Fatalf("parseError returned %T for an unrecognized code, want a plain error", err)
+	}
+	if err == nil {
+		t.Fatal("parseError returned nil")
+	}
+}
+
+func TestParseErrorMalformedBody(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rec.WriteHeader(http.StatusInternalServerError)
+	rec.Body.WriteString("not json at all")
+	resp := rec.Result()
+	defer resp.Body.Close()
+
+	if err := parseError(resp, JSONCodec{}); err == nil {
+		t.Fatal("parseError returned nil for a malformed envelope")
+	}
+}
+
+func TestIsNotLeader(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{&ErrBadRequest{Message: "nope"}, false},
+		{&ErrNotLeader{Message: "not leader"}, true},
+		{&ErrNotLeader{Message: "Not Leader: try someone else"}, true},
+	}
+	for _, c := range cases {
+		if got := isNotLeader(c.err); got != c.want {
+			t.Errorf("isNotLeader(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestCodecForNegotiation(t *testing.T) {
+	s := &HTTPServer{codecs: map[string]Codec{
+		JSONCodec{}.ContentType(): JSONCodec{},
+		GobCodec{}.ContentType():  GobCodec{},
+	}}
+
+	req := httptest.NewRequest("POST", "/raft/appendentries", nil)
+	req.Header.Set("Content-Type", GobCodec{}.ContentType())
+	if _, ok := s.codecFor(req).(GobCodec); !ok {
+		t.Errorf("codecFor chose %T for %s, want GobCodec", s.codecFor(req), GobCodec{}.ContentType())
+	}
+
+	req = httptest.NewRequest("POST", "/raft/appendentries", nil)
+	req.Header.Set("Content-Type", "application/unknown")
+	if _, ok := s.codecFor(req).(JSONCodec); !ok {
+		t.Errorf("codecFor chose %T for an unrecognized Content-Type, want JSONCodec fallback", s.codecFor(req))
+	}
+}
+
+// TestCodecForNegotiationViaAccept covers InstallSnapshot's case: the body
+// has its own Content-Type (raw snapshot bytes, not codec-encoded), so
+// codecFor must use Accept to pick the codec for an error
+// response instead of defaulting to JSON regardless of the caller's codec.
+func TestCodecForNegotiationViaAccept(t *testing.T) {
+	s := &HTTPServer{codecs: map[string]Codec{
+		JSONCodec{}.ContentType(): JSONCodec{},
+		GobCodec{}.ContentType():  GobCodec{},
+	}}
+
+	req := httptest.NewRequest("POST", "/raft/installsnapshot", nil)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Accept", GobCodec{}.ContentType())
+	if _, ok := s.codecFor(req).(GobCodec); !ok {
+		t.Errorf("codecFor chose %T for Accept: %s, want GobCodec", s.codecFor(req), GobCodec{}.ContentType())
+	}
+}
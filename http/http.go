@@ -1,43 +1,56 @@
 package rafthttp
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"github.com/peterbourgon/raft"
-	"io/ioutil"
+	"io"
 	"net/http"
 	"net/url"
+	"sync"
+	"time"
 )
 
 const (
-	IdPath            = "/raft/id"
-	AppendEntriesPath = "/raft/appendentries"
-	RequestVotePath   = "/raft/requestvote"
-	CommandPath       = "/raft/command"
+	IdPath               = "/raft/id"
+	AppendEntriesPath    = "/raft/appendentries"
+	RequestVotePath      = "/raft/requestvote"
+	CommandPath          = "/raft/command"
+	SetConfigurationPath = "/raft/setconfiguration"
 )
 
-var (
-	emptyAppendEntriesResponse bytes.Buffer
-	emptyRequestVoteResponse   bytes.Buffer
-)
-
-func init() {
-	json.NewEncoder(&emptyAppendEntriesResponse).Encode(raft.AppendEntriesResponse{})
-	json.NewEncoder(&emptyRequestVoteResponse).Encode(raft.RequestVoteResponse{})
+// PeerConfig identifies one member of the cluster as carried over the wire
+// by SetConfiguration: enough to both address it (URL) and identify it
+// (Id) without an extra round trip to IdPath.
+type PeerConfig struct {
+	Id  uint64 `json:"id"`
+	URL string `json:"url"`
 }
 
 type HTTPPeer struct {
-	id  uint64
-	url url.URL
+	id             uint64
+	url            url.URL
+	client         *http.Client
+	codec          Codec
+	stream         *streamPeer
+	commandTimeout time.Duration
 }
 
 func NewHTTPPeer(u url.URL) (*HTTPPeer, error) {
+	return newHTTPPeer(u, http.DefaultClient)
+}
+
+func newHTTPPeer(u url.URL, client *http.Client) (*HTTPPeer, error) {
 	u.Path = ""
 
 	idUrl := u
 	idUrl.Path = IdPath
-	resp, err := http.Get(idUrl.String())
+	resp, err := client.Get(idUrl.String())
 	if err != nil {
 		return nil, err
 	}
@@ -49,14 +62,45 @@ func NewHTTPPeer(u url.URL) (*HTTPPeer, error) {
 	}
 
 	return &HTTPPeer{
-		id:  id,
-		url: u,
+		id:     id,
+		url:    u,
+		client: client,
+		codec:  JSONCodec{},
 	}, nil
 }
 
 func (p *HTTPPeer) Id() uint64 { return p.id }
 
+// SetCodec changes the wire codec used for subsequent RPCs to this peer.
+// The default is JSONCodec; GobCodec trades debuggability for lower
+// marshalling cost on AppendEntries-heavy workloads, and requires the peer
+// on the other end to be able to decode it too.
+func (p *HTTPPeer) SetCodec(c Codec) { p.codec = c }
+
+// SetCommandTimeout bounds how long Command waits for a response before
+// canceling the request, since Command's signature is fixed by the raft.Peer
+// interface and so can't take a context of its own; callers that need to
+// choose a deadline or cancel a specific call should use CommandCtx
+// directly instead. The default, zero, means Command waits indefinitely,
+// matching the original behavior.
+func (p *HTTPPeer) SetCommandTimeout(d time.Duration) { p.commandTimeout = d }
+
+// EnableStreaming opts this peer into a persistent HTTP stream (see
+// streamPeer) for AppendEntries instead of one HTTP request per call, cutting per-heartbeat
+// handshake and framing overhead on busy leaders. It's off by default; if
+// the stream ever errors, AppendEntries falls back to the plain
+// per-request path for that call and the stream reconnects on the next one.
+func (p *HTTPPeer) EnableStreaming() {
+	p.stream = newStreamPeer(p)
+}
+
 func (p *HTTPPeer) AppendEntries(ae raft.AppendEntries) raft.AppendEntriesResponse {
+	if p.stream != nil {
+		if aer, err := p.stream.send(ae); err == nil {
+			return aer
+		}
+	}
+
 	var aer raft.AppendEntriesResponse
 	p.rpc(ae, AppendEntriesPath, &aer)
 	return aer
@@ -70,31 +114,102 @@ func (p *HTTPPeer) RequestVote(rv raft.RequestVote) raft.RequestVoteResponse {
 
 func (p *HTTPPeer) Command(cmd []byte, response chan []byte) error {
 	go func() {
-		var responseBuf bytes.Buffer
-		p.rpc(cmd, CommandPath, &responseBuf)
-		response <- responseBuf.Bytes()
+		ctx, cancel := p.commandCtx()
+		defer cancel()
+
+		resp, err := p.CommandCtx(ctx, cmd)
+		if notLeader, ok := err.(*ErrNotLeader); ok && notLeader.LeaderURL != "" {
+			// Transparently redirect: the peer we asked isn't the leader
+			// but told us who is, so retry there once on the caller's
+			// behalf instead of making every caller handle ErrNotLeader.
+			if leaderURL, perr := url.Parse(notLeader.LeaderURL); perr == nil {
+				leader := &HTTPPeer{url: *leaderURL, client: p.client, codec: p.codec, commandTimeout: p.commandTimeout}
+				resp, err = leader.CommandCtx(ctx, cmd)
+			}
+		}
+		if err != nil {
+			resp = nil
+		}
+		response <- resp
 	}()
-	return nil // TODO could make this smarter (i.e. timeout), with more work
+	return nil
+}
+
+// commandCtx returns the context Command runs its request under: bounded
+// by commandTimeout if SetCommandTimeout was called, otherwise an
+// uncanceled background context, matching the original behavior.
+func (p *HTTPPeer) commandCtx() (context.Context, context.CancelFunc) {
+	if p.commandTimeout <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), p.commandTimeout)
+}
+
+// CommandCtx is like Command, but blocks until the response arrives and
+// propagates ctx: if ctx is done before the peer responds, the underlying
+// HTTP request is canceled so the connection (and the commandHandler
+// goroutine waiting on it, server-side) is torn down instead of leaking.
+func (p *HTTPPeer) CommandCtx(ctx context.Context, cmd []byte) ([]byte, error) {
+	body := &bytes.Buffer{}
+	if err := p.codec.Encode(body, cmd); err != nil {
+		return nil, err
+	}
+
+	url := p.url
+	url.Path = CommandPath
+	req, err := http.NewRequestWithContext(ctx, "POST", url.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", p.codec.ContentType())
+	req.Header.Set("Accept", p.codec.ContentType())
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, parseError(resp, p.codec)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// SetConfiguration asks the peer to change the cluster's membership to
+// exactly peers, via the joint-consensus configuration entry. It's the
+// counterpart to AppendEntries/RequestVote/Command for membership changes
+// rather than log replication.
+func (p *HTTPPeer) SetConfiguration(peers []PeerConfig) error {
+	var ack struct{}
+	return p.rpc(peers, SetConfigurationPath, &ack)
 }
 
 func (p *HTTPPeer) rpc(request interface{}, path string, response interface{}) error {
 	body := &bytes.Buffer{}
-	if err := json.NewEncoder(body).Encode(request); err != nil {
+	if err := p.codec.Encode(body, request); err != nil {
 		return err
 	}
 
 	url := p.url
 	url.Path = path
-	resp, err := http.Post(url.String(), "application/json", body)
+	req, err := http.NewRequest("POST", url.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", p.codec.ContentType())
+	req.Header.Set("Accept", p.codec.ContentType())
+
+	resp, err := p.client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
+		return parseError(resp, p.codec)
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+	if err := p.codec.Decode(resp.Body, response); err != nil {
 		return err
 	}
 
@@ -103,12 +218,90 @@ func (p *HTTPPeer) rpc(request interface{}, path string, response interface{}) e
 
 type HTTPServer struct {
 	server *raft.Server
+
+	clientCAs *x509.CertPool
+
+	outboundClient *http.Client
+	outboundCodec  Codec
+
+	mu       sync.RWMutex // guards codecs and peerURLs below
+	codecs   map[string]Codec
+	peerURLs map[uint64]url.URL
 }
 
 func NewHTTPServer(server *raft.Server) *HTTPServer {
 	return &HTTPServer{
-		server: server,
+		server:         server,
+		outboundClient: http.DefaultClient,
+		outboundCodec:  JSONCodec{},
+		codecs: map[string]Codec{
+			JSONCodec{}.ContentType(): JSONCodec{},
+		},
+	}
+}
+
+// SetOutboundClient changes the client and codec this server uses to reach
+// peers it learns about on its own, rather than through a constructed
+// HTTPPeer/HTTPSPeer — currently just the peers setConfigurationHandler
+// builds for every member a configuration change lists. It should match whatever NewHTTPPeer/
+// NewHTTPSPeer the rest of the cluster was built with (e.g. the TLS client
+// passed to InstallTLS's caller), or a newly joined peer behind a TLS-only
+// listener will be unreachable. The default is http.DefaultClient and
+// JSONCodec, matching NewHTTPPeer.
+func (s *HTTPServer) SetOutboundClient(client *http.Client, codec Codec) {
+	s.outboundClient = client
+	s.outboundCodec = codec
+}
+
+// RegisterCodec makes c available for requests whose Content-Type header
+// matches c.ContentType(), in addition to the JSONCodec registered by
+// default. It's safe to call concurrently with requests being served,
+// e.g. with GobCodec alongside a live setConfigurationHandler.
+func (s *HTTPServer) RegisterCodec(c Codec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.codecs[c.ContentType()] = c
+}
+
+// RegisterPeerURL records the base URL peers can use to reach the raft
+// member with the given id, so that ErrNotLeader responses can include a
+// leader_hint for callers to transparently retry against. Safe to call
+// concurrently with requests being served.
+func (s *HTTPServer) RegisterPeerURL(id uint64, u url.URL) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peerURLs == nil {
+		s.peerURLs = map[uint64]url.URL{}
 	}
+	s.peerURLs[id] = u
+}
+
+// leaderHint returns the registered URL for the current leader, or "" if
+// none is known, for use as an ErrNotLeader leader_hint.
+func (s *HTTPServer) leaderHint() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := s.peerURLs[s.server.Leader()]
+	return u.String()
+}
+
+// codecFor returns the codec a handler should use to encode its response
+// (including error envelopes), preferring Accept over Content-Type since
+// Accept is what actually describes the encoding the caller wants back:
+// for most RPCs the two agree, since HTTPPeer.rpc sets them to the same
+// value, but InstallSnapshot's body is raw snapshot bytes with its own
+// Content-Type, so Accept is the only header carrying the caller's codec.
+// Falls back to JSONCodec if neither header names one we recognize.
+func (s *HTTPServer) codecFor(r *http.Request) Codec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c, ok := s.codecs[r.Header.Get("Accept")]; ok {
+		return c
+	}
+	if c, ok := s.codecs[r.Header.Get("Content-Type")]; ok {
+		return c
+	}
+	return JSONCodec{}
 }
 
 type Muxer interface {
@@ -120,6 +313,33 @@ func (s *HTTPServer) Install(mux Muxer) {
 	mux.HandleFunc(AppendEntriesPath, s.appendEntriesHandler())
 	mux.HandleFunc(RequestVotePath, s.requestVoteHandler())
 	mux.HandleFunc(CommandPath, s.commandHandler())
+	mux.HandleFunc(SetConfigurationPath, s.setConfigurationHandler())
+	mux.HandleFunc(InstallSnapshotPath, s.installSnapshotHandler())
+}
+
+// InstallTLS is like Install, but additionally pins the set of peers that
+// are allowed to dial in: clientCAs is used to verify the certificate
+// presented during the TLS handshake, so only peers holding a certificate
+// signed by one of those CAs can reach the handlers registered here. The
+// caller is still responsible for serving mux with a *tls.Config built from
+// TLSConfig.
+func (s *HTTPServer) InstallTLS(mux Muxer, clientCAs *x509.CertPool) {
+	s.clientCAs = clientCAs
+	s.Install(mux)
+}
+
+// TLSConfig returns a *tls.Config suitable for an *http.Server fronting this
+// HTTPServer, requiring and verifying a client certificate against the CA
+// pool passed to InstallTLS. It returns nil if InstallTLS was never called,
+// i.e. client certificate verification is not configured.
+func (s *HTTPServer) TLSConfig() *tls.Config {
+	if s.clientCAs == nil {
+		return nil
+	}
+	return &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  s.clientCAs,
+	}
 }
 
 func (s *HTTPServer) idHandler() http.HandlerFunc {
@@ -131,32 +351,82 @@ func (s *HTTPServer) idHandler() http.HandlerFunc {
 func (s *HTTPServer) appendEntriesHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
+		codec := s.codecFor(r)
+
+		if r.Header.Get(streamHeader) != "" {
+			s.streamAppendEntries(w, r, codec)
+			return
+		}
+
+		var ae raft.AppendEntries
+		if err := codec.Decode(r.Body, &ae); err != nil {
+			writeError(w, codec, http.StatusBadRequest, codeBadRequest, err.Error(), "")
+			return
+		}
+
+		aer := s.server.AppendEntries(ae)
+		w.Header().Set("Content-Type", codec.ContentType())
+		if err := codec.Encode(w, aer); err != nil {
+			writeError(w, codec, http.StatusInternalServerError, codeInternal, err.Error(), "")
+			return
+		}
+	}
+}
+
+// streamAppendEntries services a persistent stream opened by a peer with
+// HTTPPeer.EnableStreaming: it reads one length-prefixed AppendEntries per
+// iteration and writes back the matching response, flushing after each so
+// the peer sees it without waiting for the (unbounded) body to close.
+func (s *HTTPServer) streamAppendEntries(w http.ResponseWriter, r *http.Request, codec Codec) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, codec, http.StatusInternalServerError, codeInternal, "streaming not supported", "")
+		return
+	}
+
+	// The request body outlives the first response write, so the server
+	// must not fall back to its default behavior of draining it before
+	// sending headers: with an unbounded stream body that drain never
+	// finishes, and every reply would hang forever. EnableFullDuplex
+	// opts out of that drain.
+	if err := http.NewResponseController(w).EnableFullDuplex(); err != nil {
+		writeError(w, codec, http.StatusInternalServerError, codeInternal, "streaming not supported", "")
+		return
+	}
+
+	w.Header().Set("Content-Type", codec.ContentType())
+	br := bufio.NewReader(r.Body)
+	for {
 		var ae raft.AppendEntries
-		if err := json.NewDecoder(r.Body).Decode(&ae); err != nil {
-			http.Error(w, emptyAppendEntriesResponse.String(), http.StatusBadRequest)
+		if err := readFrame(br, codec, &ae); err != nil {
+			// Client closed the stream or it broke; either way there's
+			// nothing more to serve on it.
 			return
 		}
 
 		aer := s.server.AppendEntries(ae)
-		if err := json.NewEncoder(w).Encode(aer); err != nil {
-			http.Error(w, emptyAppendEntriesResponse.String(), http.StatusInternalServerError)
+		if err := writeFrame(w, codec, aer); err != nil {
 			return
 		}
+		flusher.Flush()
 	}
 }
 
 func (s *HTTPServer) requestVoteHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
+		codec := s.codecFor(r)
+
 		var rv raft.RequestVote
-		if err := json.NewDecoder(r.Body).Decode(&rv); err != nil {
-			http.Error(w, emptyRequestVoteResponse.String(), http.StatusBadRequest)
+		if err := codec.Decode(r.Body, &rv); err != nil {
+			writeError(w, codec, http.StatusBadRequest, codeBadRequest, err.Error(), "")
 			return
 		}
 
 		rvr := s.server.RequestVote(rv)
-		if err := json.NewEncoder(w).Encode(rvr); err != nil {
-			http.Error(w, emptyRequestVoteResponse.String(), http.StatusInternalServerError)
+		w.Header().Set("Content-Type", codec.ContentType())
+		if err := codec.Encode(w, rvr); err != nil {
+			writeError(w, codec, http.StatusInternalServerError, codeInternal, err.Error(), "")
 			return
 		}
 	}
@@ -165,29 +435,94 @@ func (s *HTTPServer) requestVoteHandler() http.HandlerFunc {
 func (s *HTTPServer) commandHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
+		codec := s.codecFor(r)
 
 		// TODO unfortunately, we squelch a lot of errors here.
 		// Maybe there's a way to report different classes of errors
 		// than with an empty response.
 
-		cmd, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "", http.StatusBadRequest)
+		var cmd []byte
+		if err := codec.Decode(r.Body, &cmd); err != nil {
+			writeError(w, codec, http.StatusBadRequest, codeBadRequest, err.Error(), "")
 			return
 		}
 
 		response := make(chan []byte, 1)
 		if err := s.server.Command(cmd, response); err != nil {
-			http.Error(w, "", http.StatusInternalServerError)
+			if isNotLeader(err) {
+				hint := s.leaderHint()
+				writeError(w, codec, http.StatusPreconditionFailed, codeNotLeader, err.Error(), hint)
+				return
+			}
+			writeError(w, codec, http.StatusInternalServerError, codeInternal, err.Error(), "")
 			return
 		}
 
-		resp, ok := <-response
+		writeCommandResponse(w, codec, r.Context(), response)
+	}
+}
+
+// writeCommandResponse waits for response (or ctx to end first, e.g.
+// because the client disconnected or its deadline passed) and writes the
+// matching reply. Split out from commandHandler so the
+// cancellation/drain behavior can be exercised directly in tests without
+// a real raft.Server backing it.
+func writeCommandResponse(w http.ResponseWriter, codec Codec, ctx context.Context, response chan []byte) {
+	select {
+	case resp, ok := <-response:
 		if !ok {
-			http.Error(w, "", http.StatusInternalServerError)
+			writeError(w, codec, http.StatusInternalServerError, codeInternal, "command channel closed", "")
 			return
 		}
-
 		w.Write(resp)
+	case <-ctx.Done():
+		// The client disconnected or its deadline passed; drain the
+		// response in the background so Command's goroutine isn't
+		// left blocked sending to a channel nobody reads anymore.
+		go func() { <-response }()
+		writeError(w, codec, http.StatusServiceUnavailable, codeTimeout, "timed out waiting for command", "")
+	}
+}
+
+func (s *HTTPServer) setConfigurationHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		codec := s.codecFor(r)
+
+		var configs []PeerConfig
+		if err := codec.Decode(r.Body, &configs); err != nil {
+			writeError(w, codec, http.StatusBadRequest, codeBadRequest, err.Error(), "")
+			return
+		}
+
+		peers := make([]raft.Peer, 0, len(configs))
+		for _, c := range configs {
+			u, err := url.Parse(c.URL)
+			if err != nil {
+				writeError(w, codec, http.StatusBadRequest, codeBadRequest, err.Error(), "")
+				return
+			}
+			// Use c.Id directly instead of round-tripping to u's IdPath:
+			// that would require the new peer to already be reachable
+			// (not true when joining) and could key peerURLs by a
+			// different id than the one actually added, if the fetched
+			// id ever disagreed with c.Id.
+			peer := &HTTPPeer{id: c.Id, url: *u, client: s.outboundClient, codec: s.outboundCodec}
+			s.RegisterPeerURL(c.Id, *u)
+			peers = append(peers, peer)
+		}
+
+		if err := s.server.SetConfiguration(peers...); err != nil {
+			if isNotLeader(err) {
+				hint := s.leaderHint()
+				writeError(w, codec, http.StatusPreconditionFailed, codeNotLeader, err.Error(), hint)
+				return
+			}
+			writeError(w, codec, http.StatusInternalServerError, codeInternal, err.Error(), "")
+			return
+		}
+
+		w.Header().Set("Content-Type", codec.ContentType())
+		codec.Encode(w, struct{}{})
 	}
 }
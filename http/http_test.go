@@ -0,0 +1,130 @@
+package rafthttp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCommandRedirectsToLeader(t *testing.T) {
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var cmd []byte
+		codec := JSONCodec{}
+		if err := codec.Decode(r.Body, &cmd); err != nil {
+			t.Errorf("leader: decode cmd: %v", err)
+		}
+		w.Write(append([]byte("leader handled: "), cmd...))
+	}))
+	defer leader.Close()
+
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, JSONCodec{}, http.StatusPreconditionFailed, codeNotLeader, "not leader", leader.URL)
+	}))
+	defer follower.Close()
+
+	u, err := url.Parse(follower.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &HTTPPeer{url: *u, client: http.DefaultClient, codec: JSONCodec{}}
+
+	response := make(chan []byte, 1)
+	if err := peer.Command([]byte("do-it"), response); err != nil {
+		t.Fatalf("Command: %v", err)
+	}
+
+	want := "leader handled: do-it"
+	if got := string(<-response); got != want {
+		t.Errorf("response = %q, want %q", got, want)
+	}
+}
+
+func TestCommandNotLeaderWithoutHintDoesNotRedirect(t *testing.T) {
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, JSONCodec{}, http.StatusPreconditionFailed, codeNotLeader, "not leader", "")
+	}))
+	defer follower.Close()
+
+	u, err := url.Parse(follower.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &HTTPPeer{url: *u, client: http.DefaultClient, codec: JSONCodec{}}
+
+	response := make(chan []byte, 1)
+	if err := peer.Command([]byte("do-it"), response); err != nil {
+		t.Fatalf("Command: %v", err)
+	}
+
+	if got := <-response; got != nil {
+		t.Errorf("response = %q, want nil (no leader hint to redirect to)", got)
+	}
+}
+
+// TestWriteCommandResponseDrainsOnCancel exercises commandHandler's
+// cancellation path directly (it's the part that fixes the goroutine leak
+// the request was about): when ctx ends before a response arrives, it must
+// reply with codeTimeout and still drain response, rather than leaving
+// whatever's sending on it (raft.Server.Command's own goroutine) blocked
+// forever.
+func TestWriteCommandResponseDrainsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Unbuffered, so the late send below only succeeds if something is
+	// actually receiving on response.
+	response := make(chan []byte)
+	rec := httptest.NewRecorder()
+	writeCommandResponse(rec, JSONCodec{}, ctx, response)
+
+	resp := rec.Result()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	err := parseError(resp, JSONCodec{})
+	if _, ok := err.(*ErrTimeout); !ok {
+		t.Fatalf("parseError returned %T, want *ErrTimeout", err)
+	}
+
+	select {
+	case response <- []byte("late"):
+	case <-time.After(time.Second):
+		t.Fatal("response was never drained after ctx was canceled; sender would leak")
+	}
+}
+
+// TestCommandTimeoutBoundsWait checks SetCommandTimeout actually bounds
+// Command's wait: Command's signature is fixed by the raft.Peer interface,
+// so a per-peer timeout is the only way its callers get a deadline at all.
+func TestCommandTimeoutBoundsWait(t *testing.T) {
+	follower := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Deliberately never replies within the test's patience; a real
+		// server wouldn't either during e.g. a leader failover. A closed
+		// client connection doesn't reliably cancel r.Context() once the
+		// (small, already-buffered) request body has fully arrived, so
+		// this sleeps rather than waiting on ctx itself.
+		time.Sleep(2 * time.Second)
+	}))
+	defer follower.CloseClientConnections()
+
+	u, err := url.Parse(follower.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &HTTPPeer{url: *u, client: http.DefaultClient, codec: JSONCodec{}}
+	peer.SetCommandTimeout(50 * time.Millisecond)
+
+	response := make(chan []byte, 1)
+	if err := peer.Command([]byte("do-it"), response); err != nil {
+		t.Fatalf("Command: %v", err)
+	}
+
+	select {
+	case <-response:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Command did not honor SetCommandTimeout")
+	}
+}
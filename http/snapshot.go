@@ -0,0 +1,84 @@
+package rafthttp
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/peterbourgon/raft"
+)
+
+// InstallSnapshotPath lets a leader push a point-in-time snapshot to a
+// follower that has fallen too far behind to catch up by replaying the
+// log, which otherwise isn't viable for long-running clusters.
+const InstallSnapshotPath = "/raft/installsnapshot"
+
+const (
+	snapshotIndexHeader = "X-Raft-Snapshot-Index"
+	snapshotTermHeader  = "X-Raft-Snapshot-Term"
+)
+
+// InstallSnapshot streams snap to the peer. The body is piped straight
+// from snap.Data with a real Content-Length, never buffered in memory,
+// since snapshots can be arbitrarily large; snap.LastIndex/snap.LastTerm
+// travel as headers rather than in the body so the server can validate
+// them before reading a single byte of data.
+func (p *HTTPPeer) InstallSnapshot(snap raft.Snapshot) error {
+	url := p.url
+	url.Path = InstallSnapshotPath
+	req, err := http.NewRequest("POST", url.String(), snap.Data)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = snap.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// The body itself is raw snapshot bytes, not codec-encoded, so
+	// Content-Type can't carry the caller's codec the way it does for
+	// other RPCs; Accept does instead, so codecFor can still pick the
+	// right codec for an error response.
+	req.Header.Set("Accept", p.codec.ContentType())
+	req.Header.Set(snapshotIndexHeader, strconv.FormatUint(snap.LastIndex, 10))
+	req.Header.Set(snapshotTermHeader, strconv.FormatUint(snap.LastTerm, 10))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return parseError(resp, p.codec)
+	}
+	return nil
+}
+
+func (s *HTTPServer) installSnapshotHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		codec := s.codecFor(r)
+
+		index, err := strconv.ParseUint(r.Header.Get(snapshotIndexHeader), 10, 64)
+		if err != nil {
+			writeError(w, codec, http.StatusBadRequest, codeBadRequest, "missing or invalid "+snapshotIndexHeader, "")
+			return
+		}
+		term, err := strconv.ParseUint(r.Header.Get(snapshotTermHeader), 10, 64)
+		if err != nil {
+			writeError(w, codec, http.StatusBadRequest, codeBadRequest, "missing or invalid "+snapshotTermHeader, "")
+			return
+		}
+
+		// r.Body streams straight into the restore hook; we never
+		// buffer the snapshot here, since it can be arbitrarily large.
+		if err := s.server.InstallSnapshot(index, term, r.Body); err != nil {
+			if isNotLeader(err) {
+				hint := s.leaderHint()
+				writeError(w, codec, http.StatusPreconditionFailed, codeNotLeader, err.Error(), hint)
+				return
+			}
+			writeError(w, codec, http.StatusInternalServerError, codeInternal, err.Error(), "")
+			return
+		}
+
+		w.Header().Set("Content-Type", codec.ContentType())
+		codec.Encode(w, struct{}{})
+	}
+}
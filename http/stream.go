@@ -0,0 +1,187 @@
+package rafthttp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/peterbourgon/raft"
+)
+
+// streamHeader marks a request as opening a long-lived AppendEntries
+// stream rather than a one-off RPC.
+const streamHeader = "X-Raft-Stream"
+
+// streamPeer maintains a single long-lived HTTP request whose body is a
+// length-prefixed sequence of AppendEntries requests, and whose response
+// body is the matching sequence of responses. Reusing one stream for all
+// of a leader's heartbeats to a given follower avoids the TCP/TLS
+// handshake and JSON-framing cost of HTTPPeer.rpc on every beat. It
+// reconnects automatically after an error; HTTPPeer.AppendEntries falls
+// back to the plain per-request path for the append that triggered it.
+// The request is HTTP/2 only if the peer's client negotiates it: over
+// plain http://, or with the transport NewHTTPSPeer builds, it is a
+// full-duplex HTTP/1.1 request instead.
+type streamPeer struct {
+	peer *HTTPPeer
+
+	mu      sync.Mutex
+	w       *io.PipeWriter
+	pending chan doResult
+	resp    *http.Response
+	r       *bufio.Reader
+	closed  bool
+}
+
+// doResult carries the outcome of the background client.Do call back to
+// the sender once response headers arrive.
+type doResult struct {
+	resp *http.Response
+	err  error
+}
+
+func newStreamPeer(peer *HTTPPeer) *streamPeer {
+	return &streamPeer{peer: peer}
+}
+
+func (sp *streamPeer) send(ae raft.AppendEntries) (raft.AppendEntriesResponse, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	var aer raft.AppendEntriesResponse
+	if sp.closed {
+		return aer, fmt.Errorf("rafthttp: stream closed")
+	}
+
+	if err := sp.connect(); err != nil {
+		return aer, err
+	}
+
+	// Write before waiting on headers: client.Do won't see response
+	// headers until the server has read a frame off the request body, and
+	// the request body is this pipe, so the write has to happen
+	// concurrently with (not after) the connection being established.
+	if err := writeFrame(sp.w, sp.peer.codec, ae); err != nil {
+		sp.reset()
+		return aer, err
+	}
+
+	if sp.r == nil {
+		result := <-sp.pending
+		if result.err != nil {
+			sp.reset()
+			return aer, result.err
+		}
+		if result.resp.StatusCode != http.StatusOK {
+			result.resp.Body.Close()
+			sp.reset()
+			return aer, fmt.Errorf("HTTP %d", result.resp.StatusCode)
+		}
+		sp.resp = result.resp
+		sp.r = bufio.NewReader(result.resp.Body)
+	}
+
+	if err := readFrame(sp.r, sp.peer.codec, &aer); err != nil {
+		sp.reset()
+		return aer, err
+	}
+
+	return aer, nil
+}
+
+// connect opens the persistent stream if it isn't already open. The
+// request is issued in a background goroutine since client.Do blocks until
+// response headers arrive, which on this handler requires a frame to
+// already be flowing through the request body; connect only sets up the
+// pipe and hands the result to send via sp.pending once it's ready.
+// Callers must hold sp.mu.
+func (sp *streamPeer) connect() error {
+	if sp.w != nil {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	url := sp.peer.url
+	url.Path = AppendEntriesPath
+	req, err := http.NewRequest("POST", url.String(), pr)
+	if err != nil {
+		pw.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", sp.peer.codec.ContentType())
+	req.Header.Set("Accept", sp.peer.codec.ContentType())
+	req.Header.Set(streamHeader, "1")
+
+	pending := make(chan doResult, 1)
+	go func() {
+		resp, err := sp.peer.client.Do(req)
+		pending <- doResult{resp: resp, err: err}
+	}()
+
+	sp.w = pw
+	sp.pending = pending
+	return nil
+}
+
+// reset tears down a broken stream so the next send reconnects, closing
+// the response body so its connection isn't leaked: once sp.r is set, it's
+// the only remaining reference to sp.resp's body. Callers must hold sp.mu.
+func (sp *streamPeer) reset() {
+	if sp.w != nil {
+		sp.w.Close()
+	}
+	if sp.resp != nil {
+		sp.resp.Body.Close()
+	}
+	sp.w = nil
+	sp.resp = nil
+	sp.r = nil
+	sp.pending = nil
+}
+
+func (sp *streamPeer) Close() error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.closed = true
+	sp.reset()
+	return nil
+}
+
+// writeFrame and readFrame implement the length-prefixed framing carried
+// by the stream body: a 4-byte big-endian length followed by that many
+// codec-encoded bytes, so a reader knows where one message ends and the
+// next begins within a single unbounded body.
+func writeFrame(w io.Writer, codec Codec, v interface{}) error {
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, v); err != nil {
+		return err
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(buf.Len()))
+	if _, err := w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readFrame(r *bufio.Reader, codec Codec, v interface{}) error {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	frame := io.LimitReader(r, int64(n))
+	if err := codec.Decode(frame, v); err != nil {
+		return err
+	}
+	// Skip whatever the codec left unread (e.g. JSONCodec's trailing
+	// newline) so the next read starts at the next frame's length.
+	_, err := io.Copy(io.Discard, frame)
+	return err
+}
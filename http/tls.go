@@ -0,0 +1,27 @@
+package rafthttp
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NewHTTPSPeer is like NewHTTPPeer, but dials the peer over HTTPS using
+// tlsConf. Set tlsConf.Certificates to present a client certificate, and
+// tlsConf.RootCAs to verify the peer's certificate, for mutual
+// authentication between cluster members. timeout bounds the underlying
+// TCP dial, not the TLS handshake or the request itself.
+func NewHTTPSPeer(u url.URL, tlsConf *tls.Config, timeout time.Duration) (*HTTPPeer, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: (&net.Dialer{
+				Timeout: timeout,
+			}).Dial,
+			TLSClientConfig:    tlsConf,
+			DisableCompression: true,
+		},
+	}
+	return newHTTPPeer(u, client)
+}